@@ -0,0 +1,141 @@
+package azkv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// concatKDF and the AES Key Wrap helpers below are the building blocks of an
+// ECDH-ES data-key wrap, but no Encrypt or Decrypt path in this package calls
+// them: EC-backed Key Vault keys are not used to wrap a data key at all. Key
+// Vault has no key-agreement operation for EC keys, only sign/verify, so
+// Encrypt rejects EC keys instead (see KeyTypeEC in keysource.go).
+//
+// The helpers are self-contained RFC 3394 / NIST SP 800-56A implementations,
+// exercised only by their own tests.
+
+// concatKDF implements the single-step Concat KDF from NIST SP 800-56A section
+// 5.8.1 with SHA-256, the same construction JOSE ECDH-ES (RFC 7518 section 4.6.2)
+// uses to turn a raw ECDH shared secret into a symmetric key.
+func concatKDF(secret []byte, algorithmID string, keyLen int) []byte {
+	algID := lengthPrefixed([]byte(algorithmID))
+	partyUInfo := lengthPrefixed(nil)
+	partyVInfo := lengthPrefixed(nil)
+	suppPubInfo := make([]byte, 4)
+	binary.BigEndian.PutUint32(suppPubInfo, uint32(keyLen)*8)
+
+	out := make([]byte, 0, keyLen)
+	for counter := uint32(1); len(out) < keyLen; counter++ {
+		h := sha256.New()
+		var counterBytes [4]byte
+		binary.BigEndian.PutUint32(counterBytes[:], counter)
+		h.Write(counterBytes[:])
+		h.Write(secret)
+		h.Write(algID)
+		h.Write(partyUInfo)
+		h.Write(partyVInfo)
+		h.Write(suppPubInfo)
+		out = append(out, h.Sum(nil)...)
+	}
+	return out[:keyLen]
+}
+
+func lengthPrefixed(data []byte) []byte {
+	out := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(out, uint32(len(data)))
+	copy(out[4:], data)
+	return out
+}
+
+// aesKWDefaultIV is the default integrity check value from RFC 3394 section 2.2.3.1.
+var aesKWDefaultIV = [8]byte{0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6}
+
+// aesKeyWrap implements the AES Key Wrap algorithm from RFC 3394, wrapping
+// plaintext under kek. No data-key path in this package calls it.
+func aesKeyWrap(kek, plaintext []byte) ([]byte, error) {
+	if len(plaintext)%8 != 0 {
+		return nil, fmt.Errorf("azkv: key to wrap must be a multiple of 8 bytes")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(plaintext) / 8
+	r := make([][]byte, n)
+	for i := range r {
+		r[i] = append([]byte(nil), plaintext[i*8:(i+1)*8]...)
+	}
+
+	a := append([]byte(nil), aesKWDefaultIV[:]...)
+	buf := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 0; i < n; i++ {
+			copy(buf[:8], a)
+			copy(buf[8:], r[i])
+			block.Encrypt(buf, buf)
+
+			var tBytes [8]byte
+			binary.BigEndian.PutUint64(tBytes[:], uint64(n*j+i+1))
+			for k := range a {
+				a[k] = buf[k] ^ tBytes[k]
+			}
+			r[i] = append([]byte(nil), buf[8:]...)
+		}
+	}
+
+	out := make([]byte, 0, 8+len(plaintext))
+	out = append(out, a...)
+	for _, b := range r {
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+// aesKeyUnwrap is the inverse of aesKeyWrap.
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 16 {
+		return nil, fmt.Errorf("azkv: wrapped key has invalid length")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := append([]byte(nil), wrapped[:8]...)
+	r := make([][]byte, n)
+	for i := range r {
+		r[i] = append([]byte(nil), wrapped[(i+1)*8:(i+2)*8]...)
+	}
+
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n - 1; i >= 0; i-- {
+			var tBytes [8]byte
+			binary.BigEndian.PutUint64(tBytes[:], uint64(n*j+i+1))
+			xored := make([]byte, 8)
+			for k := range a {
+				xored[k] = a[k] ^ tBytes[k]
+			}
+			copy(buf[:8], xored)
+			copy(buf[8:], r[i])
+			block.Decrypt(buf, buf)
+			a = append([]byte(nil), buf[:8]...)
+			r[i] = append([]byte(nil), buf[8:]...)
+		}
+	}
+
+	if !bytes.Equal(a, aesKWDefaultIV[:]) {
+		return nil, fmt.Errorf("azkv: integrity check failed while unwrapping key")
+	}
+
+	out := make([]byte, 0, n*8)
+	for _, b := range r {
+		out = append(out, b...)
+	}
+	return out, nil
+}
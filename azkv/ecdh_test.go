@@ -0,0 +1,121 @@
+package azkv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Known-answer test vector from RFC 3394 section 4.1 (128-bit KEK wrapping a
+// 128-bit key).
+func TestAESKeyWrapRFC3394Vector(t *testing.T) {
+	kek, err := hex.DecodeString("000102030405060708090A0B0C0D0E0F")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := hex.DecodeString("00112233445566778899AABBCCDDEEFF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const wantHex = "1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5"
+
+	got, err := aesKeyWrap(kek, plaintext)
+	if err != nil {
+		t.Fatalf("aesKeyWrap: %v", err)
+	}
+	if gotHex := hex.EncodeToString(got); !strings.EqualFold(gotHex, wantHex) {
+		t.Fatalf("aesKeyWrap = %s, want %s", gotHex, wantHex)
+	}
+}
+
+func TestAESKeyWrapUnwrapRoundTrip(t *testing.T) {
+	kek := make([]byte, 32)
+	for i := range kek {
+		kek[i] = byte(i)
+	}
+
+	for _, n := range []int{8, 16, 24, 32, 40} {
+		plaintext := make([]byte, n)
+		for i := range plaintext {
+			plaintext[i] = byte(n + i)
+		}
+
+		wrapped, err := aesKeyWrap(kek, plaintext)
+		if err != nil {
+			t.Fatalf("aesKeyWrap(%d bytes): %v", n, err)
+		}
+		if len(wrapped) != n+8 {
+			t.Fatalf("aesKeyWrap(%d bytes) produced %d bytes, want %d", n, len(wrapped), n+8)
+		}
+
+		unwrapped, err := aesKeyUnwrap(kek, wrapped)
+		if err != nil {
+			t.Fatalf("aesKeyUnwrap(%d bytes): %v", n, err)
+		}
+		if !bytes.Equal(unwrapped, plaintext) {
+			t.Fatalf("aesKeyUnwrap(%d bytes) = %x, want %x", n, unwrapped, plaintext)
+		}
+	}
+}
+
+func TestAESKeyWrapRejectsNonMultipleOf8(t *testing.T) {
+	kek := make([]byte, 16)
+	if _, err := aesKeyWrap(kek, make([]byte, 10)); err == nil {
+		t.Fatal("expected error for plaintext not a multiple of 8 bytes")
+	}
+}
+
+func TestAESKeyUnwrapDetectsCorruption(t *testing.T) {
+	kek := make([]byte, 16)
+	plaintext := make([]byte, 16)
+	for i := range plaintext {
+		plaintext[i] = byte(i)
+	}
+
+	wrapped, err := aesKeyWrap(kek, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped[len(wrapped)-1] ^= 0xFF
+
+	if _, err := aesKeyUnwrap(kek, wrapped); err == nil {
+		t.Fatal("expected integrity check failure for corrupted ciphertext")
+	}
+}
+
+func TestConcatKDFDeterministic(t *testing.T) {
+	secret := []byte("shared secret bytes")
+	a := concatKDF(secret, "A128KW", 16)
+	b := concatKDF(secret, "A128KW", 16)
+	if !bytes.Equal(a, b) {
+		t.Fatalf("concatKDF is not deterministic: %x != %x", a, b)
+	}
+}
+
+func TestConcatKDFLength(t *testing.T) {
+	secret := []byte("shared secret bytes")
+	for _, n := range []int{16, 24, 32, 48} {
+		out := concatKDF(secret, "A256KW", n)
+		if len(out) != n {
+			t.Fatalf("concatKDF(keyLen=%d) returned %d bytes", n, len(out))
+		}
+	}
+}
+
+func TestConcatKDFVariesWithAlgorithmID(t *testing.T) {
+	secret := []byte("shared secret bytes")
+	a := concatKDF(secret, "A128KW", 16)
+	b := concatKDF(secret, "A256KW", 16)
+	if bytes.Equal(a, b) {
+		t.Fatal("concatKDF output should depend on algorithmID")
+	}
+}
+
+func TestConcatKDFVariesWithSecret(t *testing.T) {
+	a := concatKDF([]byte("secret one"), "A128KW", 16)
+	b := concatKDF([]byte("secret two"), "A128KW", 16)
+	if bytes.Equal(a, b) {
+		t.Fatal("concatKDF output should depend on the shared secret")
+	}
+}
@@ -6,25 +6,68 @@ package azkv //import "go.mozilla.org/sops/azkv"
 
 import (
 	"context"
+	"crypto/rsa"
 	"encoding/base64"
 	"fmt"
+	"os"
 	"regexp"
 	"strings"
 	"time"
 
 	"go.mozilla.org/sops/logging"
 
-	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
-	"github.com/Azure/azure-sdk-for-go/services/keyvault/auth"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
 	"github.com/sirupsen/logrus"
 )
 
+// KeyType identifies the kind of key stored in Key Vault, which determines how the
+// sops data key is wrapped.
+type KeyType string
+
+const (
+	// KeyTypeRSA wraps the data key directly with RSA-OAEP-256 via the vault's
+	// encrypt/decrypt operations.
+	KeyTypeRSA KeyType = "RSA"
+	// KeyTypeEC is detected so Encrypt can fail clearly: Key Vault has no
+	// key-agreement operation, and EC keys there only support sign/verify, so
+	// there is no Key Vault primitive this package can use to wrap a data key
+	// for an EC key.
+	KeyTypeEC KeyType = "EC"
+)
+
 var log *logrus.Logger
 
 func init() {
 	log = logging.NewLogger("AZKV")
 }
 
+// CredentialOptions overrides individual parts of the credential chain used to
+// authenticate against Azure Key Vault. Any field left empty falls back to the
+// corresponding environment variable, so existing MasterKeys that never set
+// Credential keep authenticating exactly as azidentity.DefaultAzureCredential
+// decides: environment variables, Workload Identity (AKS federated tokens),
+// Managed Identity, then the Azure CLI.
+type CredentialOptions struct {
+	// TenantID overrides AZURE_TENANT_ID.
+	TenantID string
+	// ClientID overrides AZURE_CLIENT_ID. Combined with FederatedTokenFilePath
+	// or ClientSecret it selects the principal to use with those credentials;
+	// set alone, it instead requests a specific user-assigned managed identity,
+	// since DefaultAzureCredential itself has no way to target one.
+	ClientID string
+	// FederatedTokenFilePath overrides AZURE_FEDERATED_TOKEN_FILE, used for Azure
+	// Workload Identity.
+	FederatedTokenFilePath string
+	// CertificatePath overrides AZURE_CLIENT_CERTIFICATE_PATH with the path to a
+	// PEM or PFX file holding the service principal's certificate and private
+	// key, used for certificate-based authentication.
+	CertificatePath string
+	// ClientSecret overrides AZURE_CLIENT_SECRET.
+	ClientSecret string
+}
+
 // MasterKey is a Azure Key Vault key used to encrypt and decrypt sops' data key.
 type MasterKey struct {
 	VaultURL string
@@ -33,18 +76,104 @@ type MasterKey struct {
 
 	EncryptedKey string
 	CreationDate time.Time
+
+	// Credential optionally overrides the default Azure credential chain used to
+	// authenticate to Key Vault. When nil, azidentity.DefaultAzureCredential is
+	// used as-is.
+	Credential *CredentialOptions
+
+	// KeyType records whether the underlying Key Vault key is RSA or EC. It is
+	// detected lazily from the vault on first Encrypt, so Encrypt can fail with
+	// a clear error for EC keys instead of attempting an operation Key Vault
+	// doesn't support. Decrypt always assumes RSA, since EC keys can never have
+	// produced an EncryptedKey to begin with.
+	KeyType KeyType
+
+	// PublicKey, if set directly by the caller, is used to wrap the data key
+	// locally instead of calling Key Vault, regardless of Offline.
+	PublicKey *rsa.PublicKey
+	// Offline makes Encrypt use PublicKey, loading it from the on-disk cache
+	// populated by a prior online Encrypt or PrefetchPublicKey if PublicKey
+	// isn't already set, and never reach out to Key Vault. Without Offline, a
+	// cached public key is never consulted, so an ordinary online Encrypt
+	// always talks to Key Vault and picks up key rotation. Decrypt always
+	// calls Key Vault regardless of Offline.
+	Offline bool
+	// CachePath overrides where the RSA public key fetched from Key Vault is
+	// cached on disk. If empty, a default under $XDG_CACHE_HOME is used.
+	CachePath string
 }
 
-func newKeyVaultClient() (keyvault.BaseClient, error) {
-	var err error
-	c := keyvault.New()
-	c.Authorizer, err = auth.NewAuthorizerFromEnvironment()
+func newKeyVaultClient(key *MasterKey) (*azkeys.Client, error) {
+	return newClient(key.VaultURL, key.Credential)
+}
+
+// newClient builds an azkeys.Client for vaultURL, authenticated per credOpts.
+// Shared by MasterKey and SigningKey, which both talk to Key Vault the same way.
+func newClient(vaultURL string, credOpts *CredentialOptions) (*azkeys.Client, error) {
+	cred, err := newCredential(credOpts)
+	if err != nil {
+		log.WithError(err).Error("Failed to create Azure credential")
+		return nil, err
+	}
+
+	client, err := azkeys.NewClient(vaultURL, cred, nil)
 	if err != nil {
-		log.WithError(err).Error("Failed to create Azure authorizer")
-		return c, err
+		log.WithError(err).Error("Failed to create Azure Key Vault client")
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// newCredential builds the azcore.TokenCredential used to talk to Key Vault. With
+// no CredentialOptions it defers entirely to azidentity.DefaultAzureCredential,
+// which already chains environment variables, Workload Identity (federated
+// tokens), Managed Identity and the Azure CLI. When opts sets a federated token
+// file, a service principal secret or certificate, or (on its own) a client ID,
+// that specific credential is constructed directly instead, since
+// DefaultAzureCredential has no way to target a user-assigned managed identity.
+func newCredential(opts *CredentialOptions) (azcore.TokenCredential, error) {
+	if opts == nil {
+		return azidentity.NewDefaultAzureCredential(nil)
+	}
+
+	tenantID, clientID := opts.TenantID, opts.ClientID
+	if tenantID == "" {
+		tenantID = os.Getenv("AZURE_TENANT_ID")
+	}
+	if clientID == "" {
+		clientID = os.Getenv("AZURE_CLIENT_ID")
 	}
 
-	return c, nil
+	switch {
+	case opts.FederatedTokenFilePath != "":
+		return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			TenantID:      tenantID,
+			ClientID:      clientID,
+			TokenFilePath: opts.FederatedTokenFilePath,
+		})
+	case opts.ClientSecret != "":
+		return azidentity.NewClientSecretCredential(tenantID, clientID, opts.ClientSecret, nil)
+	case opts.CertificatePath != "":
+		data, err := os.ReadFile(opts.CertificatePath)
+		if err != nil {
+			return nil, fmt.Errorf("azkv: failed to read certificate %q: %v", opts.CertificatePath, err)
+		}
+		certs, key, err := azidentity.ParseCertificates(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("azkv: failed to parse certificate %q: %v", opts.CertificatePath, err)
+		}
+		return azidentity.NewClientCertificateCredential(tenantID, clientID, certs, key, nil)
+	case opts.ClientID != "":
+		// DefaultAzureCredential has no way to override just the managed identity
+		// client ID, so a user-assigned identity is requested directly instead.
+		return azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
+			ID: azidentity.ClientID(opts.ClientID),
+		})
+	}
+
+	return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{TenantID: opts.TenantID})
 }
 
 // NewMasterKey creates a new MasterKey from an URL, key name and version, setting the creation date to the current date
@@ -100,16 +229,73 @@ func (key *MasterKey) SetEncryptedDataKey(enc []byte) {
 	key.EncryptedKey = string(enc)
 }
 
-// Encrypt takes a sops data key, encrypts it with Key Vault and stores the result in the EncryptedKey field
+// Encrypt takes a sops data key, encrypts it with Key Vault and stores the result
+// in the EncryptedKey field. It is equivalent to EncryptWithContext with a context
+// bounded by RequestTimeout.
 func (key *MasterKey) Encrypt(dataKey []byte) error {
-	c, err := newKeyVaultClient()
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+	return key.EncryptWithContext(ctx, dataKey)
+}
+
+// EncryptWithContext takes a sops data key, encrypts it with Key Vault and stores
+// the result in the EncryptedKey field. Retryable Key Vault errors are retried
+// with backoff as described on MaxRetries, RetryMaxBackoff and RequestTimeout.
+func (key *MasterKey) EncryptWithContext(ctx context.Context, dataKey []byte) error {
+	if key.Offline && key.PublicKey == nil && key.KeyType != KeyTypeEC {
+		pub, err := key.loadCachedPublicKey()
+		if err != nil {
+			return fmt.Errorf("azkv: offline encryption requested for %s but no cached public key: %v", key.Name, err)
+		}
+		key.PublicKey = pub
+		if key.KeyType == "" {
+			key.KeyType = KeyTypeRSA
+		}
+	}
+	if key.PublicKey != nil {
+		return key.encryptRSALocal(dataKey)
+	}
+	if key.Offline {
+		return fmt.Errorf("azkv: offline encryption is only supported for RSA keys")
+	}
+
+	c, err := newKeyVaultClient(key)
 	if err != nil {
 		return err
 	}
-	data := base64.RawURLEncoding.EncodeToString(dataKey)
-	p := keyvault.KeyOperationsParameters{Value: &data, Algorithm: keyvault.RSAOAEP256}
 
-	res, err := c.Encrypt(context.Background(), key.VaultURL, key.Name, key.Version, p)
+	if key.KeyType == "" {
+		jwk, err := key.fetchPublicKey(ctx, c)
+		if err != nil {
+			log.WithError(err).WithFields(logrus.Fields{
+				"key":     key.Name,
+				"version": key.Version,
+			}).Error("Failed to determine Key Vault key type")
+			return err
+		}
+		key.KeyType = keyTypeFromJWK(jwk)
+		if key.KeyType == KeyTypeEC {
+			return fmt.Errorf("azkv: key %s is an EC key, which Key Vault cannot use to wrap a data key (no key-agreement operation, only sign/verify)", key.Name)
+		}
+		if err := key.cachePublicKey(jwk); err != nil {
+			log.WithError(err).WithFields(logrus.Fields{
+				"key":     key.Name,
+				"version": key.Version,
+			}).Warn("Failed to cache Key Vault public key")
+		}
+	} else if key.KeyType == KeyTypeEC {
+		return fmt.Errorf("azkv: key %s is an EC key, which Key Vault cannot use to wrap a data key (no key-agreement operation, only sign/verify)", key.Name)
+	}
+
+	alg := azkeys.JSONWebKeyEncryptionAlgorithmRSAOAEP256
+	p := azkeys.KeyOperationsParameters{Value: dataKey, Algorithm: &alg}
+
+	var res azkeys.EncryptResponse
+	err = withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		res, err = c.Encrypt(ctx, key.Name, key.Version, p, nil)
+		return err
+	})
 	if err != nil {
 		log.WithError(err).WithFields(logrus.Fields{
 			"key":     key.Name,
@@ -118,7 +304,7 @@ func (key *MasterKey) Encrypt(dataKey []byte) error {
 		return fmt.Errorf("Failed to encrypt data: %v", err)
 	}
 
-	key.EncryptedKey = *res.Result
+	key.EncryptedKey = base64.RawURLEncoding.EncodeToString(res.Result)
 	log.WithFields(logrus.Fields{
 		"key":     key.Name,
 		"version": key.Version,
@@ -127,6 +313,41 @@ func (key *MasterKey) Encrypt(dataKey []byte) error {
 	return nil
 }
 
+// fetchPublicKey retrieves the public portion of the Key Vault key, which is
+// enough to determine its KeyType and, for RSA keys, to cache the key for
+// offline Encrypt.
+func (key *MasterKey) fetchPublicKey(ctx context.Context, c *azkeys.Client) (azkeys.JSONWebKey, error) {
+	return fetchKeyJWK(ctx, c, key.Name, key.Version)
+}
+
+// fetchKeyJWK retrieves the public portion of a Key Vault key by name and
+// version. Shared by MasterKey and SigningKey.
+func fetchKeyJWK(ctx context.Context, c *azkeys.Client, name, version string) (azkeys.JSONWebKey, error) {
+	var resp azkeys.GetKeyResponse
+	err := withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.GetKey(ctx, name, version, nil)
+		return err
+	})
+	if err != nil {
+		return azkeys.JSONWebKey{}, fmt.Errorf("azkv: failed to fetch key %s: %v", name, err)
+	}
+	if resp.Key == nil || resp.Key.Kty == nil {
+		return azkeys.JSONWebKey{}, fmt.Errorf("azkv: key %s has no key type", name)
+	}
+	return *resp.Key, nil
+}
+
+func keyTypeFromJWK(jwk azkeys.JSONWebKey) KeyType {
+	if jwk.Kty != nil {
+		switch *jwk.Kty {
+		case azkeys.JSONWebKeyTypeEC, azkeys.JSONWebKeyTypeECHSM:
+			return KeyTypeEC
+		}
+	}
+	return KeyTypeRSA
+}
+
 // EncryptIfNeeded encrypts the provided sops' data key and encrypts it if it hasn't been encrypted yet
 func (key *MasterKey) EncryptIfNeeded(dataKey []byte) error {
 	if key.EncryptedKey == "" {
@@ -135,37 +356,60 @@ func (key *MasterKey) EncryptIfNeeded(dataKey []byte) error {
 	return nil
 }
 
-// Decrypt decrypts the EncryptedKey field with Azure Key Vault and returns the result.
+// Decrypt decrypts the EncryptedKey field with Azure Key Vault and returns the
+// result. It is equivalent to DecryptWithContext with a context bounded by
+// RequestTimeout.
 func (key *MasterKey) Decrypt() ([]byte, error) {
-	c, err := newKeyVaultClient()
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+	return key.DecryptWithContext(ctx)
+}
+
+// DecryptWithContext decrypts the EncryptedKey field with Azure Key Vault and
+// returns the result. Retryable Key Vault errors are retried with backoff as
+// described on MaxRetries, RetryMaxBackoff and RequestTimeout.
+func (key *MasterKey) DecryptWithContext(ctx context.Context) ([]byte, error) {
+	c, err := newKeyVaultClient(key)
 	if err != nil {
 		return nil, err
 	}
-	p := keyvault.KeyOperationsParameters{Value: &key.EncryptedKey, Algorithm: keyvault.RSAOAEP256}
 
-	res, err := c.Decrypt(context.TODO(), key.VaultURL, key.Name, key.Version, p)
+	raw, err := base64.RawURLEncoding.DecodeString(key.EncryptedKey)
 	if err != nil {
 		log.WithError(err).WithFields(logrus.Fields{
 			"key":     key.Name,
 			"version": key.Version,
 		}).Error("Decryption failed")
-		return nil, fmt.Errorf("Error decrypting key: %v", err)
+		return nil, err
 	}
 
-	plaintext, err := base64.RawURLEncoding.DecodeString(*res.Result)
+	key.KeyType = KeyTypeRSA
+	return key.decryptRSA(ctx, c, raw)
+}
+
+func (key *MasterKey) decryptRSA(ctx context.Context, c *azkeys.Client, value []byte) ([]byte, error) {
+	alg := azkeys.JSONWebKeyEncryptionAlgorithmRSAOAEP256
+	p := azkeys.KeyOperationsParameters{Value: value, Algorithm: &alg}
+
+	var res azkeys.DecryptResponse
+	err := withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		res, err = c.Decrypt(ctx, key.Name, key.Version, p, nil)
+		return err
+	})
 	if err != nil {
 		log.WithError(err).WithFields(logrus.Fields{
 			"key":     key.Name,
 			"version": key.Version,
 		}).Error("Decryption failed")
-		return nil, err
+		return nil, fmt.Errorf("Error decrypting key: %v", err)
 	}
 
 	log.WithFields(logrus.Fields{
 		"key":     key.Name,
 		"version": key.Version,
 	}).Info("Decryption succeeded")
-	return plaintext, nil
+	return res.Result, nil
 }
 
 // NeedsRotation returns whether the data key needs to be rotated or not.
@@ -0,0 +1,150 @@
+package azkv
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// rsaCacheJWK is the on-disk representation of a cached RSA public key, used so
+// Encrypt can run without talking to Key Vault.
+type rsaCacheJWK struct {
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// cachePath returns the file a Key Vault RSA public key is cached under.
+// CachePath overrides it; otherwise it defaults to
+// $XDG_CACHE_HOME/sops/azkv/<vault>/<key>/<version>.jwk, falling back to
+// ~/.cache when XDG_CACHE_HOME is unset.
+func (key *MasterKey) cachePath() string {
+	if key.CachePath != "" {
+		return key.CachePath
+	}
+
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		base = filepath.Join(home, ".cache")
+	}
+
+	vault := strings.TrimPrefix(strings.TrimPrefix(key.VaultURL, "https://"), "http://")
+	return filepath.Join(base, "sops", "azkv", vault, key.Name, key.Version+".jwk")
+}
+
+// loadCachedPublicKey reads back a public key previously stored by cachePublicKey.
+func (key *MasterKey) loadCachedPublicKey() (*rsa.PublicKey, error) {
+	path := key.cachePath()
+	if path == "" {
+		return nil, fmt.Errorf("azkv: no cache path available")
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwk rsaCacheJWK
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return nil, fmt.Errorf("azkv: invalid cached public key at %s: %v", path, err)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, fmt.Errorf("azkv: invalid cached public key at %s: %v", path, err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, fmt.Errorf("azkv: invalid cached public key at %s: %v", path, err)
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: bigEndianInt(e)}, nil
+}
+
+// cachePublicKey writes jwk's RSA modulus and exponent to the on-disk cache.
+func (key *MasterKey) cachePublicKey(jwk azkeys.JSONWebKey) error {
+	path := key.cachePath()
+	if path == "" {
+		return fmt.Errorf("azkv: no cache path available")
+	}
+
+	raw, err := json.Marshal(rsaCacheJWK{
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(jwk.N),
+		E:   base64.RawURLEncoding.EncodeToString(jwk.E),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, raw, 0o600)
+}
+
+func bigEndianInt(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n
+}
+
+// encryptRSALocal wraps dataKey with the cached RSA public key instead of calling
+// Key Vault, for CI pipelines with no outbound Azure access. It produces the
+// same ciphertext format as the online RSA-OAEP path, so Decrypt (which always
+// calls Key Vault) unwraps it unchanged.
+func (key *MasterKey) encryptRSALocal(dataKey []byte) error {
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.PublicKey, dataKey, nil)
+	if err != nil {
+		log.WithError(err).WithFields(logrus.Fields{
+			"key":     key.Name,
+			"version": key.Version,
+		}).Error("Encryption failed")
+		return fmt.Errorf("Failed to encrypt data: %v", err)
+	}
+
+	key.EncryptedKey = base64.RawURLEncoding.EncodeToString(ciphertext)
+	log.WithFields(logrus.Fields{
+		"key":     key.Name,
+		"version": key.Version,
+	}).Info("Encryption succeeded (offline)")
+	return nil
+}
+
+// PrefetchPublicKey fetches key's RSA public key from Key Vault once and stores
+// it in the on-disk cache used by offline Encrypt, so that a later Encrypt with
+// Offline set can run without network access. This module defines no
+// command-line flag that calls it.
+func PrefetchPublicKey(ctx context.Context, key *MasterKey) error {
+	c, err := newKeyVaultClient(key)
+	if err != nil {
+		return err
+	}
+
+	jwk, err := key.fetchPublicKey(ctx, c)
+	if err != nil {
+		return err
+	}
+	if keyTypeFromJWK(jwk) != KeyTypeRSA {
+		return fmt.Errorf("azkv: offline prefetch is only supported for RSA keys")
+	}
+
+	return key.cachePublicKey(jwk)
+}
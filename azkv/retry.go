@@ -0,0 +1,104 @@
+package azkv
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+var (
+	// MaxRetries is the number of times a retryable Key Vault error (HTTP
+	// 408/429/500/502/503/504, network errors) is retried before giving up.
+	MaxRetries = 4
+	// RetryMaxBackoff caps the exponential backoff between retries.
+	RetryMaxBackoff = 30 * time.Second
+	// RequestTimeout bounds how long Encrypt/Decrypt wait for Key Vault when
+	// called without an explicit context, via EncryptWithContext/DecryptWithContext.
+	RequestTimeout = 30 * time.Second
+)
+
+// withRetry runs op, retrying with exponential backoff and jitter while the
+// error it returns is retryable and MaxRetries hasn't been exhausted. A
+// Retry-After header on the underlying HTTP response, when present, takes
+// precedence over the computed backoff.
+func withRetry(ctx context.Context, op func(ctx context.Context) error) error {
+	backoff := time.Second
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = op(ctx)
+		if err == nil || attempt == MaxRetries || !isRetryable(err) {
+			return err
+		}
+
+		wait := retryAfter(err)
+		if wait <= 0 {
+			wait = jitter(backoff)
+			if backoff *= 2; backoff > RetryMaxBackoff {
+				backoff = RetryMaxBackoff
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// isRetryable reports whether err is a Key Vault response with a retryable HTTP
+// status (408/429/500/502/503/504) or a network-level error.
+func isRetryable(err error) bool {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryAfter extracts the delay requested by a Retry-After response header, if
+// any. It supports both the delay-seconds and HTTP-date forms.
+func retryAfter(err error) time.Duration {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) || respErr.RawResponse == nil {
+		return 0
+	}
+
+	v := respErr.RawResponse.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// jitter returns a duration in [d/2, d), so retries spread out instead of
+// synchronizing against the same backoff schedule.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
@@ -0,0 +1,117 @@
+package azkv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+func responseError(statusCode int, header http.Header) *azcore.ResponseError {
+	return &azcore.ResponseError{
+		StatusCode: statusCode,
+		RawResponse: &http.Response{
+			StatusCode: statusCode,
+			Header:     header,
+		},
+	}
+}
+
+func TestIsRetryableStatusCodes(t *testing.T) {
+	retryable := []int{
+		http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	}
+	for _, code := range retryable {
+		if !isRetryable(responseError(code, nil)) {
+			t.Errorf("isRetryable(%d) = false, want true", code)
+		}
+	}
+
+	nonRetryable := []int{
+		http.StatusOK,
+		http.StatusBadRequest,
+		http.StatusUnauthorized,
+		http.StatusForbidden,
+		http.StatusNotFound,
+	}
+	for _, code := range nonRetryable {
+		if isRetryable(responseError(code, nil)) {
+			t.Errorf("isRetryable(%d) = true, want false", code)
+		}
+	}
+}
+
+type fakeNetError struct{}
+
+func (fakeNetError) Error() string   { return "fake network error" }
+func (fakeNetError) Timeout() bool   { return true }
+func (fakeNetError) Temporary() bool { return true }
+
+func TestIsRetryableNetworkError(t *testing.T) {
+	var netErr net.Error = fakeNetError{}
+	if !isRetryable(netErr) {
+		t.Error("isRetryable(net.Error) = false, want true")
+	}
+	if !isRetryable(fmt.Errorf("dial: %w", netErr)) {
+		t.Error("isRetryable should unwrap to find a net.Error")
+	}
+}
+
+func TestIsRetryableOtherErrors(t *testing.T) {
+	if isRetryable(errors.New("some other error")) {
+		t.Error("isRetryable(plain error) = true, want false")
+	}
+}
+
+func TestRetryAfterDelaySeconds(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "5")
+	got := retryAfter(responseError(http.StatusTooManyRequests, header))
+	if got != 5*time.Second {
+		t.Errorf("retryAfter = %v, want 5s", got)
+	}
+}
+
+func TestRetryAfterHTTPDate(t *testing.T) {
+	future := time.Now().Add(10 * time.Second)
+	header := http.Header{}
+	header.Set("Retry-After", future.UTC().Format(http.TimeFormat))
+
+	got := retryAfter(responseError(http.StatusServiceUnavailable, header))
+	// Allow a little slack for the time spent formatting/parsing above.
+	if got <= 0 || got > 11*time.Second {
+		t.Errorf("retryAfter = %v, want close to 10s", got)
+	}
+}
+
+func TestRetryAfterMissingHeader(t *testing.T) {
+	got := retryAfter(responseError(http.StatusServiceUnavailable, http.Header{}))
+	if got != 0 {
+		t.Errorf("retryAfter = %v, want 0 for missing header", got)
+	}
+}
+
+func TestRetryAfterNonResponseError(t *testing.T) {
+	if got := retryAfter(errors.New("boom")); got != 0 {
+		t.Errorf("retryAfter = %v, want 0 for non-ResponseError", got)
+	}
+}
+
+func TestJitterStaysInRange(t *testing.T) {
+	d := 2 * time.Second
+	for i := 0; i < 50; i++ {
+		got := jitter(d)
+		if got < d/2 || got >= d {
+			t.Fatalf("jitter(%v) = %v, want in [%v, %v)", d, got, d/2, d)
+		}
+	}
+}
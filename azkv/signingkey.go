@@ -0,0 +1,244 @@
+package azkv
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// SigningKey is an Azure Key Vault asymmetric key used to sign and verify the
+// MAC/tree of an encrypted sops file, anchoring its integrity in an HSM-backed
+// key independent of the data-key wrapping MasterKey provides.
+type SigningKey struct {
+	VaultURL string
+	Name     string
+	Version  string
+
+	// Credential optionally overrides the default Azure credential chain, as on
+	// MasterKey.
+	Credential *CredentialOptions
+
+	// Algorithm is the JWA signature algorithm to use. If empty, it is detected
+	// lazily from the key's type and curve: RS256 for RSA keys, and ES256/
+	// ES384/ES512 for EC keys on the P-256/P-384/P-521 curves.
+	Algorithm azkeys.JSONWebKeySignatureAlgorithm
+}
+
+// NewSigningKey creates a new SigningKey from a vault URL, key name and version.
+func NewSigningKey(vaultURL string, keyName string, keyVersion string) *SigningKey {
+	return &SigningKey{VaultURL: vaultURL, Name: keyName, Version: keyVersion}
+}
+
+// NewSigningKeyFromURL takes an Azure Key Vault key URL and returns a new
+// SigningKey. URL format is {vaultUrl}/keys/{key-name}/{key-version}, the same
+// as NewMasterKeyFromURL.
+func NewSigningKeyFromURL(url string) (*SigningKey, error) {
+	re := regexp.MustCompile("^(https://[^/]+)/keys/([^/]+)/([^/]+)$")
+	parts := re.FindStringSubmatch(url)
+	if parts == nil || len(parts) < 4 {
+		return nil, fmt.Errorf("azkv: could not parse valid signing key from %q", url)
+	}
+	return &SigningKey{VaultURL: parts[1], Name: parts[2], Version: parts[3]}, nil
+}
+
+// ToString converts the key to a string representation, in the same format
+// NewSigningKeyFromURL parses.
+func (s *SigningKey) ToString() string {
+	return fmt.Sprintf("%s/keys/%s/%s", s.VaultURL, s.Name, s.Version)
+}
+
+func signatureAlgorithmFromJWK(jwk azkeys.JSONWebKey) (azkeys.JSONWebKeySignatureAlgorithm, error) {
+	if jwk.Kty == nil {
+		return "", fmt.Errorf("azkv: key has no key type")
+	}
+	switch *jwk.Kty {
+	case azkeys.JSONWebKeyTypeRSA, azkeys.JSONWebKeyTypeRSAHSM:
+		return azkeys.JSONWebKeySignatureAlgorithmRS256, nil
+	case azkeys.JSONWebKeyTypeEC, azkeys.JSONWebKeyTypeECHSM:
+		if jwk.Crv == nil {
+			return "", fmt.Errorf("azkv: EC key has no curve")
+		}
+		switch *jwk.Crv {
+		case azkeys.JSONWebKeyCurveNameP256:
+			return azkeys.JSONWebKeySignatureAlgorithmES256, nil
+		case azkeys.JSONWebKeyCurveNameP384:
+			return azkeys.JSONWebKeySignatureAlgorithmES384, nil
+		case azkeys.JSONWebKeyCurveNameP521:
+			return azkeys.JSONWebKeySignatureAlgorithmES512, nil
+		}
+		return "", fmt.Errorf("azkv: unsupported EC curve %q for signing", *jwk.Crv)
+	}
+	return "", fmt.Errorf("azkv: unsupported key type %q for signing", *jwk.Kty)
+}
+
+// algorithm returns s.Algorithm, detecting and caching it from the vault key's
+// type and curve if it isn't already set.
+func (s *SigningKey) algorithm(ctx context.Context, c *azkeys.Client) (azkeys.JSONWebKeySignatureAlgorithm, error) {
+	if s.Algorithm != "" {
+		return s.Algorithm, nil
+	}
+
+	jwk, err := fetchKeyJWK(ctx, c, s.Name, s.Version)
+	if err != nil {
+		return "", err
+	}
+	alg, err := signatureAlgorithmFromJWK(jwk)
+	if err != nil {
+		return "", err
+	}
+
+	s.Algorithm = alg
+	return alg, nil
+}
+
+// Sign signs digest with the Key Vault key and returns the signature. It is
+// equivalent to SignWithContext with a context bounded by RequestTimeout.
+func (s *SigningKey) Sign(digest []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+	return s.SignWithContext(ctx, digest)
+}
+
+// SignWithContext signs digest with the Key Vault key and returns the signature.
+// Retryable Key Vault errors are retried with backoff as described on
+// MaxRetries, RetryMaxBackoff and RequestTimeout.
+func (s *SigningKey) SignWithContext(ctx context.Context, digest []byte) ([]byte, error) {
+	c, err := newClient(s.VaultURL, s.Credential)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := s.algorithm(ctx, c)
+	if err != nil {
+		log.WithError(err).WithFields(logrus.Fields{
+			"key":     s.Name,
+			"version": s.Version,
+		}).Error("Failed to determine Key Vault signature algorithm")
+		return nil, err
+	}
+
+	var res azkeys.SignResponse
+	err = withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		res, err = c.Sign(ctx, s.Name, s.Version, azkeys.SignParameters{Algorithm: &alg, Value: digest}, nil)
+		return err
+	})
+	if err != nil {
+		log.WithError(err).WithFields(logrus.Fields{
+			"key":     s.Name,
+			"version": s.Version,
+		}).Error("Signing failed")
+		return nil, fmt.Errorf("azkv: failed to sign: %v", err)
+	}
+
+	log.WithFields(logrus.Fields{
+		"key":     s.Name,
+		"version": s.Version,
+	}).Info("Signing succeeded")
+	return res.Result, nil
+}
+
+// Verify checks sig against digest using the Key Vault key. It is equivalent to
+// VerifyWithContext with a context bounded by RequestTimeout.
+func (s *SigningKey) Verify(digest, sig []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+	return s.VerifyWithContext(ctx, digest, sig)
+}
+
+// VerifyWithContext checks sig against digest using the Key Vault key. Retryable
+// Key Vault errors are retried with backoff as described on MaxRetries,
+// RetryMaxBackoff and RequestTimeout.
+func (s *SigningKey) VerifyWithContext(ctx context.Context, digest, sig []byte) error {
+	c, err := newClient(s.VaultURL, s.Credential)
+	if err != nil {
+		return err
+	}
+
+	alg, err := s.algorithm(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	var res azkeys.VerifyResponse
+	err = withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		res, err = c.Verify(ctx, s.Name, s.Version, azkeys.VerifyParameters{Algorithm: &alg, Digest: digest, Signature: sig}, nil)
+		return err
+	})
+	if err != nil {
+		log.WithError(err).WithFields(logrus.Fields{
+			"key":     s.Name,
+			"version": s.Version,
+		}).Error("Signature verification failed")
+		return fmt.Errorf("azkv: failed to verify signature: %v", err)
+	}
+	if res.Value == nil || !*res.Value {
+		log.WithFields(logrus.Fields{
+			"key":     s.Name,
+			"version": s.Version,
+		}).Error("Signature verification failed")
+		return fmt.Errorf("azkv: signature verification failed for %s", s.ToString())
+	}
+
+	log.WithFields(logrus.Fields{
+		"key":     s.Name,
+		"version": s.Version,
+	}).Info("Signature verification succeeded")
+	return nil
+}
+
+// Signature is a single Key Vault signature over a sops file's MAC/tree digest,
+// the shape an entry under the sops metadata "azure_kv_signatures" block takes.
+// Wiring that block into sops' own Metadata type, which this package doesn't
+// define, is left to the caller; Signature only carries the identity/signature
+// pair and how to produce and check it.
+type Signature struct {
+	// Signer identifies the signing key as vaultUrl/keys/name/version.
+	Signer string
+	// Signature is the base64url-encoded signature bytes.
+	Signature string
+}
+
+// NewSignature signs digest with key and returns the Signature to store under
+// azure_kv_signatures.
+func NewSignature(key *SigningKey, digest []byte) (*Signature, error) {
+	sig, err := key.Sign(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{
+		Signer:    key.ToString(),
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
+	}, nil
+}
+
+// Verify checks sig against digest using the Key Vault key identified by
+// sig.Signer, optionally authenticating with credential instead of the default
+// Azure credential chain.
+func (sig *Signature) Verify(digest []byte, credential *CredentialOptions) error {
+	key, err := NewSigningKeyFromURL(sig.Signer)
+	if err != nil {
+		return err
+	}
+	key.Credential = credential
+
+	raw, err := base64.RawURLEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return fmt.Errorf("azkv: invalid signature encoding: %v", err)
+	}
+	return key.Verify(digest, raw)
+}
+
+// ToMap converts the Signature to a map for serialization under the
+// azure_kv_signatures metadata block.
+func (sig Signature) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"signer":    sig.Signer,
+		"signature": sig.Signature,
+	}
+}